@@ -0,0 +1,74 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// localBlobCache maps a chunk digest to a local file path where its
+// content was last fetched, so that chunks shared across image pulls
+// (e.g. common base layers) are hardlinked instead of re-downloaded.
+type localBlobCache struct {
+	mu    sync.Mutex
+	path  string
+	index map[string]string
+}
+
+func newLocalBlobCache(indexpath string) *localBlobCache {
+	c := &localBlobCache{path: indexpath, index: make(map[string]string)}
+
+	if buf, err := ioutil.ReadFile(indexpath); err == nil {
+		json.Unmarshal(buf, &c.index)
+	}
+
+	return c
+}
+
+// lookup returns a local path previously recorded for digest, if it still
+// exists on disk.
+func (c *localBlobCache) lookup(digest string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.index[digest]
+	if !ok {
+		return "", false
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		return "", false
+	}
+
+	return p, true
+}
+
+func (c *localBlobCache) record(digest string, filepath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index[digest] = filepath
+
+	if buf, err := json.Marshal(c.index); err == nil {
+		os.MkdirAll(path.Dir(c.path), 0775)
+		ioutil.WriteFile(c.path, buf, 0644)
+	}
+}
+
+var (
+	sharedBlobCacheOnce sync.Once
+	sharedBlobCache     *localBlobCache
+)
+
+// blobCache returns the process-wide chunk cache, used to skip
+// downloading a chunk whose content is already present on disk from a
+// previously pulled image.
+func (cln *ZImageClient) blobCache() *localBlobCache {
+	sharedBlobCacheOnce.Do(func() {
+		sharedBlobCache = newLocalBlobCache(GetBlobCacheIndexPath())
+	})
+
+	return sharedBlobCache
+}
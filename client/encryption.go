@@ -0,0 +1,80 @@
+package client
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"image-store/registry/storage"
+	"io/ioutil"
+	"os"
+)
+
+func loadRSAPrivateKey(keypath string) (*rsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %s", keypath, err)
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM-encoded key", keypath)
+	}
+
+	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %s", keypath, err)
+	}
+
+	return priv, nil
+}
+
+// decryptBlob decrypts the blob at ciphertextPath using cln.DecryptKeyPath
+// (set via --decrypt-key) against enc, returning the path to the
+// decrypted plaintext. It refuses to run, leaving no plaintext on disk,
+// when no matching recipient key is configured.
+func (cln *ZImageClient) decryptBlob(ciphertextPath string, enc *storage.Encryption) (string, error) {
+	if cln.DecryptKeyPath == "" {
+		return "", fmt.Errorf("image blob is encrypted but no --decrypt-key was given")
+	}
+
+	priv, err := loadRSAPrivateKey(cln.DecryptKeyPath)
+	if err != nil {
+		return "", err
+	}
+
+	var cek []byte
+	for _, r := range enc.Recipients {
+		if k, err := storage.UnwrapKeyRSAOAEP(priv, r); err == nil {
+			cek = k
+			break
+		}
+	}
+
+	if cek == nil {
+		return "", fmt.Errorf("no recipient in the manifest matches --decrypt-key")
+	}
+
+	in, err := os.Open(ciphertextPath)
+	if err != nil {
+		return "", err
+	}
+
+	defer in.Close()
+
+	plainPath := ciphertextPath + ".dec"
+	out, err := os.OpenFile(plainPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	defer out.Close()
+
+	if err := storage.DecryptBlob(out, in, cek, enc.IV); err != nil {
+		os.Remove(plainPath)
+		return "", fmt.Errorf("failed to decrypt image blob: %s", err)
+	}
+
+	os.Remove(ciphertextPath)
+	return plainPath, nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"image-store/registry/api/v1"
+	"io"
+	"testing"
+)
+
+func testBlobManifest() *v1.BlobManifest {
+	return &v1.BlobManifest{
+		Chunks: []v1.ChunkEntry{
+			{Subhash: "a", Offset: 0, UncompressedSize: 10},
+			{Subhash: "b", Offset: 10, UncompressedSize: 10},
+		},
+	}
+}
+
+func TestChunkForFindsContainingChunk(t *testing.T) {
+	lb := &LazyBlob{bmf: testBlobManifest()}
+
+	ce, ok := lb.chunkFor(12)
+	if !ok {
+		t.Fatal("expected offset 12 to fall inside the second chunk")
+	}
+
+	if ce.Subhash != "b" {
+		t.Fatalf("got chunk %q, want %q", ce.Subhash, "b")
+	}
+}
+
+func TestChunkForPastEnd(t *testing.T) {
+	lb := &LazyBlob{bmf: testBlobManifest()}
+
+	if _, ok := lb.chunkFor(20); ok {
+		t.Fatal("expected offset past the last chunk to report not found")
+	}
+}
+
+func TestReadAtPastEndReturnsEOFNotShortReadWithNilError(t *testing.T) {
+	lb := &LazyBlob{bmf: testBlobManifest()}
+
+	buf := make([]byte, 4)
+	n, err := lb.ReadAt(buf, 20)
+
+	if err != io.EOF {
+		t.Fatalf("ReadAt past end: err = %v, want io.EOF", err)
+	}
+
+	if n != 0 {
+		t.Fatalf("ReadAt past end: n = %d, want 0", n)
+	}
+}
+
+func TestReadAtNegativeOffset(t *testing.T) {
+	lb := &LazyBlob{bmf: testBlobManifest()}
+
+	if _, err := lb.ReadAt(make([]byte, 4), -1); err == nil {
+		t.Fatal("expected a negative offset to be rejected")
+	}
+}
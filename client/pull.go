@@ -1,14 +1,18 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
 	"image-store/registry/api/errcode"
 	"image-store/registry/api/v1"
+	"image-store/registry/storage"
 	"image-store/utils"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
+	"sync"
 )
 
 // Returns a list of image ids of which we need to pull from server.
@@ -36,7 +40,16 @@ func (cln *ZImageClient) buildChain(leaf *v1.ImageManifest) ([]*v1.ImageManifest
 	return res, nil
 }
 
-// Pull a disk image
+// Pull a disk image, fully materializing its blob on disk via
+// downloadChunks/io.Copy before returning. This still gets the chunk-level
+// benefits of the chunked format - chunks shared with an already-pulled
+// image are hardlinked rather than re-fetched (see fetchChunkAt) - but it
+// does not give near-zero-bytes pulls of a rebased image or let a caller
+// start reading before the download finishes: that needs the chunks to
+// stay lazy end-to-end, which only PullLazy/LazyBlob provide today, and
+// only as a loopback reader, not yet mounted through FUSE. Callers that
+// want to boot off a large qcow2 before its full download completes
+// should use PullLazy instead of Pull.
 func (cln *ZImageClient) Pull(name string, reference string) error {
 	imf, err := cln.getImageManifest(name, reference)
 	if err != nil {
@@ -67,6 +80,10 @@ func (cln *ZImageClient) Pull(name string, reference string) error {
 }
 
 func (cln *ZImageClient) doPull(imf *v1.ImageManifest) error {
+	if err := cln.verifyManifest(imf); err != nil {
+		return fmt.Errorf("refusing to pull %s: %s", imf.Name, err)
+	}
+
 	bmf, err := cln.getBlobManifest(imf.Name, imf.Blobsum)
 	if err != nil {
 		return err
@@ -77,6 +94,12 @@ func (cln *ZImageClient) doPull(imf *v1.ImageManifest) error {
 		return err
 	}
 
+	if imf.Encryption != nil {
+		if imgfile, err = cln.decryptBlob(imgfile, imf.Encryption); err != nil {
+			return err
+		}
+	}
+
 	// the file name for saving the blob image
 	blobpath := GetImageBlobPath(imf.Name, imf.Blobsum)
 	os.MkdirAll(path.Dir(blobpath), 0775)
@@ -103,6 +126,27 @@ func finalizeBlobAndManifest(blobpath string, imf *v1.ImageManifest) error {
 	return nil
 }
 
+// headChunkSize asks the server for the full size of a chunk without
+// fetching its body, so downloadChunk knows whether a partial file on
+// disk is actually incomplete or just corrupted.
+func (cln *ZImageClient) headChunkSize(route string) (int64, error) {
+	resp, err := cln.Head(route)
+	if err != nil {
+		return 0, fmt.Errorf("failed to head chunk: %s", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("failed to head chunk: status %d", resp.StatusCode)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// downloadChunk fetches a single chunk into dldir, resuming from the
+// current on-disk length via a Range request when a previous attempt
+// was interrupted partway through.
 func (cln *ZImageClient) downloadChunk(dldir string, subhash string, route string) error {
 	dlfile := path.Join(dldir, subhash)
 
@@ -110,29 +154,91 @@ func (cln *ZImageClient) downloadChunk(dldir string, subhash string, route strin
 		return nil
 	}
 
-	w, err := os.OpenFile(dlfile, os.O_CREATE|os.O_WRONLY, 0644)
+	if cached, ok := cln.blobCache().lookup(subhash); ok {
+		os.Remove(dlfile)
+		if os.Link(cached, dlfile) == nil && checkChunkDigest(dlfile, subhash) == nil {
+			return nil
+		}
+		os.Remove(dlfile)
+	}
+
+	var offset int64
+	flags := os.O_CREATE | os.O_WRONLY
+
+	if fi, err := os.Stat(dlfile); err == nil && fi.Size() > 0 {
+		// Only issue a HEAD - and so only require the chunk route to
+		// support one - when there's an actual partial download on disk
+		// to validate. A fresh, non-resumed download has nothing to
+		// check the size against and must not depend on HEAD working.
+		size, err := cln.headChunkSize(route)
+		if err != nil {
+			return err
+		}
+
+		if fi.Size() >= size {
+			// a stale or corrupted partial download - start over, and
+			// truncate so bytes past the old (larger) size don't linger
+			// past what this fresh download writes.
+			flags |= os.O_TRUNC
+		} else {
+			offset = fi.Size()
+		}
+	}
+
+	w, err := os.OpenFile(dlfile, flags, 0644)
 	if err != nil {
 		return err
 	}
 
 	defer w.Close()
 
-	resp, err := cln.Get(route)
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("failed to download chunk %s", subhash)
+	if _, err = w.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to resume chunk %s: %s", subhash, err)
+	}
+
+	resp, err := cln.GetRange(route, offset)
+	if err != nil {
+		return fmt.Errorf("failed to download chunk %s: %s", subhash, err)
 	}
 
 	defer resp.Body.Close()
+
+	if offset > 0 && resp.StatusCode == 200 {
+		return fmt.Errorf("failed to download chunk %s: server ignored range request", subhash)
+	}
+
+	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+		return fmt.Errorf("failed to download chunk %s", subhash)
+	}
+
 	if _, err = io.Copy(w, resp.Body); err != nil {
 		return fmt.Errorf("failed to download chunk %s: %s", subhash, err)
 	}
 
+	cln.blobCache().record(subhash, dlfile)
 	return nil
 }
 
-// TODO
-// 1. continue from last interrupt
-// 2. check parent blobs
+// offsetWriter adapts an *os.File to io.Writer for a fixed starting
+// offset, so a downloaded chunk can be streamed straight into its slot in
+// the shared blob file instead of through an intermediate copy pass.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.f.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// downloadChunks fetches bmf.Chunks into dldir using up to cln.Concurrency
+// worker goroutines, writing each chunk's bytes directly at its
+// ChunkEntry.Offset in the shared blob file - chunks already present on
+// disk (from the local blob cache or a resumed partial download) are
+// reused rather than re-fetched, and no chunk needs to wait for the ones
+// before it since offsets are known upfront.
 func (cln *ZImageClient) downloadChunks(bmf *v1.BlobManifest, name, tophash string) (string, error) {
 	// create the directory for saving chunks
 	dldir := GetBlobDownloadDir(name, tophash)
@@ -140,21 +246,19 @@ func (cln *ZImageClient) downloadChunks(bmf *v1.BlobManifest, name, tophash stri
 		return "", err
 	}
 
-	// download chunks
-	for _, subhash := range bmf.Chunks {
-		route := cln.GetFullUrl(v1.GetBlobChunkRoute(name, tophash, subhash))
-		if err := cln.downloadChunk(dldir, subhash, route); err != nil {
-			return "", err
-		}
+	imgfile := path.Join(dldir, tophash)
+	if checkChunkDigest(imgfile, tophash) == nil {
+		// the combine step ran before a previous interrupt
+		return imgfile, nil
+	}
 
-		dlfile := path.Join(dldir, subhash)
-		if err := checkChunkDigest(dlfile, subhash); err != nil {
-			return "", fmt.Errorf("chunk %s corrupted: %s", subhash, err)
+	var total int64
+	for _, ce := range bmf.Chunks {
+		if end := ce.Offset + ce.UncompressedSize; end > total {
+			total = end
 		}
 	}
 
-	// combine chunk
-	imgfile := path.Join(dldir, tophash)
 	w, err := os.OpenFile(imgfile, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return "", fmt.Errorf("failed to create blob file: %s", err)
@@ -162,26 +266,94 @@ func (cln *ZImageClient) downloadChunks(bmf *v1.BlobManifest, name, tophash stri
 
 	defer w.Close()
 
-	for _, subhash := range bmf.Chunks {
-		r, err := os.Open(path.Join(dldir, subhash))
-		if err != nil {
-			return "", fmt.Errorf("failed to read chunk %s", subhash)
-		}
+	if err := w.Truncate(total); err != nil {
+		return "", fmt.Errorf("failed to size blob file: %s", err)
+	}
 
-		defer r.Close()
+	concurrency := cln.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
-		if _, err = io.Copy(w, r); err != nil {
-			return "", fmt.Errorf("failed to write image file: %s", err)
-		}
+	entries := make(chan v1.ChunkEntry)
+	errs := make(chan error, len(bmf.Chunks))
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for ce := range entries {
+				if err := cln.fetchChunkAt(w, dldir, name, tophash, ce); err != nil {
+					errs <- err
+				}
+			}
+		}()
 	}
 
-	for _, subhash := range bmf.Chunks {
-		os.Remove(path.Join(dldir, subhash))
+	for _, ce := range bmf.Chunks {
+		entries <- ce
+	}
+	close(entries)
+
+	wg.Wait()
+	close(errs)
+
+	if err := firstError(errs); err != nil {
+		return "", err
 	}
 
 	return imgfile, nil
 }
 
+// firstError drains a closed error channel and returns the first non-nil
+// error sent to it by downloadChunks' worker pool. Errors after the first
+// are discarded.
+func firstError(errs <-chan error) error {
+	var first error
+	for err := range errs {
+		if first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// fetchChunkAt resolves one chunk of a BlobManifest - hardlinking it from
+// the local blob cache when a prior image already pulled it, otherwise
+// downloading it - and writes its bytes at ce.Offset in w.
+func (cln *ZImageClient) fetchChunkAt(w *os.File, dldir, name, tophash string, ce v1.ChunkEntry) error {
+	route := cln.GetFullUrl(v1.GetBlobChunkRoute(name, tophash, ce.Subhash))
+	if err := cln.downloadChunk(dldir, ce.Subhash, route); err != nil {
+		return err
+	}
+
+	dlfile := path.Join(dldir, ce.Subhash)
+	if err := checkChunkDigest(dlfile, ce.Subhash); err != nil {
+		return fmt.Errorf("chunk %s corrupted: %s", ce.Subhash, err)
+	}
+
+	r, err := os.Open(dlfile)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %s: %s", ce.Subhash, err)
+	}
+
+	defer r.Close()
+
+	if _, err = io.Copy(&offsetWriter{f: w, off: ce.Offset}, r); err != nil {
+		return fmt.Errorf("failed to write chunk %s at offset %d: %s", ce.Subhash, ce.Offset, err)
+	}
+
+	// dlfile is left in place (downloadChunk already recorded it in
+	// blobCache) so a later pull of an image sharing this chunk can
+	// hardlink it instead of re-downloading. Removing it here, as a
+	// prior version of this function did, made every blobCache record
+	// immediately dangle.
+	return nil
+}
+
 func (cln *ZImageClient) getBlobManifest(name, tophash string) (*v1.BlobManifest, error) {
 	resp, err := cln.Get(cln.GetFullUrl(v1.GetBlobManifestRoute(name, tophash)))
 	if err != nil {
@@ -206,6 +378,11 @@ func (cln *ZImageClient) getBlobManifest(name, tophash string) (*v1.BlobManifest
 	return &bmf, nil
 }
 
+// getImageManifest fetches name:reference, transparently following it one
+// level further when it turns out to name a multi-architecture
+// ManifestList rather than a single-platform manifest: the entry matching
+// cln.Arch (default runtime.GOARCH) and runtime.GOOS is looked up and
+// re-fetched by digest instead.
 func (cln *ZImageClient) getImageManifest(name, reference string) (*v1.ImageManifest, error) {
 	resp, err := cln.Get(cln.GetFullUrl(v1.GetManifestRoute(name, reference)))
 	if err != nil {
@@ -222,16 +399,33 @@ func (cln *ZImageClient) getImageManifest(name, reference string) (*v1.ImageMani
 		return nil, e
 	}
 
-	var imf v1.ImageManifest
-	if err = utils.JsonDecode(resp.Body, &imf); err != nil {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
 		return nil, err
 	}
 
-	if !imf.Ok() {
+	var imf v1.ImageManifest
+	if err := json.Unmarshal(body, &imf); err == nil && imf.Ok() {
+		return &imf, nil
+	}
+
+	var ml storage.ManifestList
+	if err := json.Unmarshal(body, &ml); err != nil || len(ml.Manifests) == 0 {
 		return nil, fmt.Errorf("invalid image manifest for %s:%s", name, reference)
 	}
 
-	return &imf, nil
+	arch := cln.Arch
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+
+	for _, e := range ml.Manifests {
+		if e.Platform.Arch == arch && e.Platform.OS == runtime.GOOS {
+			return cln.getImageManifest(name, e.Digest)
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest for %s:%s matches platform %s/%s", name, reference, runtime.GOOS, arch)
 }
 
 func writeLocalManifest(imf *v1.ImageManifest) error {
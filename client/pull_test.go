@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"image-store/registry/api/v1"
+	"image-store/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFirstErrorReturnsFirstNonNil(t *testing.T) {
+	errs := make(chan error, 3)
+	e1 := errors.New("chunk a failed")
+	errs <- nil
+	errs <- e1
+	errs <- errors.New("chunk b failed")
+	close(errs)
+
+	if got := firstError(errs); got != e1 {
+		t.Fatalf("firstError() = %v, want %v", got, e1)
+	}
+}
+
+func TestFirstErrorNoErrors(t *testing.T) {
+	errs := make(chan error, 2)
+	errs <- nil
+	errs <- nil
+	close(errs)
+
+	if got := firstError(errs); got != nil {
+		t.Fatalf("firstError() = %v, want nil", got)
+	}
+}
+
+func TestOffsetWriterWritesAtOffset(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.OpenFile(filepath.Join(dir, "blob"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(16); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &offsetWriter{f: f, off: 8}
+	if _, err := w.Write([]byte("chunk2!!")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(make([]byte, 8), []byte("chunk2!!")...)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("file content = %q, want %q", buf, want)
+	}
+}
+
+// TestFetchChunkAtPersistsChunkForReuse guards against a regression where
+// fetchChunkAt removed the downloaded chunk file right after copying it
+// into the assembled blob, which left every blobCache().record() entry
+// pointing at a file that no longer existed - so a second image sharing
+// this chunk could never hardlink it and always re-downloaded instead.
+func TestFetchChunkAtPersistsChunkForReuse(t *testing.T) {
+	content := []byte("shared-chunk-bytes")
+	subhash, err := utils.GetChunkDigest(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dldir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dldir, subhash), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobfile, err := os.OpenFile(filepath.Join(dldir, "blob"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blobfile.Close()
+
+	if err := blobfile.Truncate(int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	ce := v1.ChunkEntry{Subhash: subhash, Offset: 0, UncompressedSize: int64(len(content))}
+
+	cln := &ZImageClient{}
+	if err := cln.fetchChunkAt(blobfile, dldir, "name", "tophash", ce); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dldir, subhash)); err != nil {
+		t.Fatalf("expected chunk %s to persist on disk for reuse by a later pull, got: %v", subhash, err)
+	}
+}
+
+func TestCheckChunkDigestMismatch(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "chunk")
+	if err := ioutil.WriteFile(p, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkChunkDigest(p, "not-the-real-digest"); err == nil {
+		t.Fatal("expected digest mismatch error, got nil")
+	}
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"fmt"
+	"image-store/registry/api/v1"
+	"image-store/registry/storage"
+	"image-store/utils"
+	"io/ioutil"
+)
+
+func loadPolicy(policyPath string) (*storage.Policy, error) {
+	buf, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy %s: %s", policyPath, err)
+	}
+
+	return storage.ParsePolicy(buf)
+}
+
+// getSignature fetches the detached signature for an already-resolved
+// manifest, returning (nil, nil) when the manifest is simply unsigned.
+func (cln *ZImageClient) getSignature(name, id string) (*storage.Signature, error) {
+	resp, err := cln.Get(cln.GetFullUrl(v1.GetManifestSignatureRoute(name, id)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signature: %s", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch signature: status %d", resp.StatusCode)
+	}
+
+	var sig storage.Signature
+	if err = utils.JsonDecode(resp.Body, &sig); err != nil {
+		return nil, err
+	}
+
+	return &sig, nil
+}
+
+// getManifestBytes re-fetches name:id and returns the exact bytes the
+// server holds for it, rather than re-serializing the client's own
+// v1.ImageManifest - the server signs storage.ImageManifest.String(), a
+// distinct type with its own field set, so any local re-encoding would
+// never byte-match what ed25519.Verify needs to check against.
+func (cln *ZImageClient) getManifestBytes(name, id string) ([]byte, error) {
+	resp, err := cln.Get(cln.GetFullUrl(v1.GetManifestRoute(name, id)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest %s: %s", id, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch manifest %s: status %d", id, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// verifyManifest enforces cln.PolicyPath, when configured, before a pulled
+// manifest's blob is linked into place. It reuses storage.Policy - the
+// same glob-matching engine GetManifest enforces server-side -
+// so a policy.json rule keyed by a name glob is honored identically on
+// both ends instead of drifting out of sync with a second copy. Pulls of
+// unsigned or wrong-signer images fail closed rather than silently
+// succeeding.
+func (cln *ZImageClient) verifyManifest(imf *v1.ImageManifest) error {
+	if cln.PolicyPath == "" {
+		return nil
+	}
+
+	p, err := loadPolicy(cln.PolicyPath)
+	if err != nil {
+		return err
+	}
+
+	sig, err := cln.getSignature(imf.Name, imf.Id)
+	if err != nil {
+		return err
+	}
+
+	buf, err := cln.getManifestBytes(imf.Name, imf.Id)
+	if err != nil {
+		return err
+	}
+
+	return p.Verify(imf.Name, buf, sig)
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// BlobLocation identifies where a previously uploaded blob with a given
+// digest was last seen. blobDigestPathSpec already keys blob storage on
+// digest alone, so within a single store this is always that one path;
+// it only becomes interesting once blob storage is name-scoped and a
+// digest can legitimately live in more than one place.
+type BlobLocation struct {
+	Path           string `json:"path"`
+	CompressedSize int64  `json:"compressedSize"`
+}
+
+// BlobInfoCache records where blob digests have been seen before. It is
+// intentionally small so the JSON-backed implementation below can later
+// be swapped for a network-backed one without touching callers.
+type BlobInfoCache interface {
+	// RecordKnownLocation remembers that digest can be found at loc.
+	RecordKnownLocation(digest string, loc BlobLocation)
+
+	// CandidateLocations returns locations previously recorded for digest,
+	// in the order they were first recorded. Empty if digest is unknown.
+	CandidateLocations(digest string) []BlobLocation
+
+	// RecordDigestUncompressedPair remembers that the blob identified by
+	// digest decompresses to the content identified by uncompressed.
+	RecordDigestUncompressedPair(digest string, uncompressed string)
+
+	// UncompressedDigest returns the uncompressed digest previously
+	// recorded for digest, or "" if none is known.
+	UncompressedDigest(digest string) string
+}
+
+type blobInfoCacheIndex struct {
+	Locations    map[string][]BlobLocation `json:"locations"`
+	Uncompressed map[string]string         `json:"uncompressed"`
+}
+
+// jsonBlobInfoCache is a BlobInfoCache backed by a single JSON index file
+// kept under the storage root via the same storagedriver.StorageDriver
+// used for everything else, rather than a separate database.
+type jsonBlobInfoCache struct {
+	ctx    context.Context
+	driver storagedriver.StorageDriver
+
+	mu  sync.Mutex
+	idx blobInfoCacheIndex
+}
+
+// NewJSONBlobInfoCache loads (or lazily creates) a BlobInfoCache backed by
+// a JSON index stored through d.
+func NewJSONBlobInfoCache(ctx context.Context, d storagedriver.StorageDriver) BlobInfoCache {
+	c := &jsonBlobInfoCache{
+		ctx:    ctx,
+		driver: d,
+		idx: blobInfoCacheIndex{
+			Locations:    make(map[string][]BlobLocation),
+			Uncompressed: make(map[string]string),
+		},
+	}
+
+	if buf, err := d.GetContent(ctx, blobInfoCachePathSpec{}.pathSpec()); err == nil {
+		// a corrupt or missing index just starts out empty
+		json.Unmarshal(buf, &c.idx)
+	}
+
+	return c
+}
+
+func (c *jsonBlobInfoCache) save() {
+	if buf, err := json.Marshal(c.idx); err == nil {
+		c.driver.PutContent(c.ctx, blobInfoCachePathSpec{}.pathSpec(), buf)
+	}
+}
+
+// addLocation appends loc to locs unless a location at the same path is
+// already recorded, so a digest that keeps getting confirmed at the same
+// spot doesn't grow an ever-longer candidate list.
+func addLocation(locs []BlobLocation, loc BlobLocation) []BlobLocation {
+	for _, known := range locs {
+		if known.Path == loc.Path {
+			return locs
+		}
+	}
+
+	return append(locs, loc)
+}
+
+func (c *jsonBlobInfoCache) RecordKnownLocation(digest string, loc BlobLocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	before := len(c.idx.Locations[digest])
+	c.idx.Locations[digest] = addLocation(c.idx.Locations[digest], loc)
+	if len(c.idx.Locations[digest]) != before {
+		c.save()
+	}
+}
+
+func (c *jsonBlobInfoCache) CandidateLocations(digest string) []BlobLocation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]BlobLocation(nil), c.idx.Locations[digest]...)
+}
+
+func (c *jsonBlobInfoCache) RecordDigestUncompressedPair(digest string, uncompressed string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idx.Uncompressed[digest] = uncompressed
+	c.save()
+}
+
+func (c *jsonBlobInfoCache) UncompressedDigest(digest string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.idx.Uncompressed[digest]
+}
+
+type blobInfoCachePathSpec struct{}
+
+func (blobInfoCachePathSpec) pathSpec() string {
+	return "/blobinfocache/index.json"
+}
@@ -0,0 +1,21 @@
+package storage
+
+import "testing"
+
+func TestAddLocationAppendsNew(t *testing.T) {
+	locs := addLocation(nil, BlobLocation{Path: "/blobs/a", CompressedSize: 10})
+	locs = addLocation(locs, BlobLocation{Path: "/blobs/b", CompressedSize: 20})
+
+	if len(locs) != 2 {
+		t.Fatalf("got %d locations, want 2", len(locs))
+	}
+}
+
+func TestAddLocationDedupesByPath(t *testing.T) {
+	locs := addLocation(nil, BlobLocation{Path: "/blobs/a", CompressedSize: 10})
+	locs = addLocation(locs, BlobLocation{Path: "/blobs/a", CompressedSize: 10})
+
+	if len(locs) != 1 {
+		t.Fatalf("got %d locations, want 1 (duplicate path should be ignored)", len(locs))
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"image-store/registry/api/v1"
+)
+
+// Encryption records how an otherwise-opaque blob was encrypted, so that
+// its ciphertext digest can still be used as the addressable Blobsum: the
+// wrapped keys and nonce layout live in the manifest rather than in the
+// blob itself.
+type Encryption struct {
+	Scheme     string      `json:"scheme"` // currently only "aes-256-gcm"
+	Recipients []Recipient `json:"recipients"`
+	IV         []byte      `json:"iv"`
+}
+
+// Recipient is one wrapped copy of the content-encryption key, decryptable
+// by whoever holds the matching private key.
+type Recipient struct {
+	KeyID      string `json:"keyId"`
+	Algorithm  string `json:"algorithm"` // "rsa-oaep"; age/X25519 is future work
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// GenerateCEK returns a random 256-bit content-encryption key.
+func GenerateCEK() ([]byte, error) {
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, fmt.Errorf("failed to generate content encryption key: %s", err)
+	}
+
+	return cek, nil
+}
+
+// WrapKeyRSAOAEP wraps cek for a single RSA recipient.
+func WrapKeyRSAOAEP(keyID string, pub *rsa.PublicKey, cek []byte) (Recipient, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, cek, nil)
+	if err != nil {
+		return Recipient{}, fmt.Errorf("failed to wrap key for %s: %s", keyID, err)
+	}
+
+	return Recipient{KeyID: keyID, Algorithm: "rsa-oaep", WrappedKey: wrapped}, nil
+}
+
+// UnwrapKeyRSAOAEP recovers a CEK wrapped by WrapKeyRSAOAEP.
+func UnwrapKeyRSAOAEP(priv *rsa.PrivateKey, r Recipient) ([]byte, error) {
+	if r.Algorithm != "rsa-oaep" {
+		return nil, fmt.Errorf("unsupported wrap algorithm %q", r.Algorithm)
+	}
+
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, r.WrappedKey, nil)
+}
+
+// frameNonce derives a unique GCM nonce for frame idx from the stream's
+// random salt, so a single CEK can safely encrypt many frames.
+func frameNonce(salt []byte, idx uint64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, salt)
+	binary.BigEndian.PutUint64(nonce[4:], idx)
+	return nonce
+}
+
+// EncryptBlob streams r through AES-256-GCM in v1.BlobChunkSize frames,
+// each length-prefixed so DecryptBlob can split them back apart, and
+// returns the random salt that must be recorded as Encryption.IV.
+func EncryptBlob(w io.Writer, r io.Reader, cek []byte) ([]byte, error) {
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 4)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce salt: %s", err)
+	}
+
+	buf := make([]byte, v1.BlobChunkSize)
+	for idx := uint64(0); ; idx++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			ciphertext := gcm.Seal(nil, frameNonce(salt, idx), buf[:n], nil)
+
+			if err := binary.Write(w, binary.BigEndian, uint32(len(ciphertext))); err != nil {
+				return nil, fmt.Errorf("failed to write frame %d: %s", idx, err)
+			}
+
+			if _, err := w.Write(ciphertext); err != nil {
+				return nil, fmt.Errorf("failed to write frame %d: %s", idx, err)
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read plaintext: %s", err)
+		}
+	}
+
+	return salt, nil
+}
+
+// DecryptBlob is the inverse of EncryptBlob.
+func DecryptBlob(w io.Writer, r io.Reader, cek []byte, salt []byte) error {
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return err
+	}
+
+	for idx := uint64(0); ; idx++ {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read frame %d: %s", idx, err)
+		}
+
+		ciphertext := make([]byte, length)
+		if _, err := io.ReadFull(r, ciphertext); err != nil {
+			return fmt.Errorf("failed to read frame %d: %s", idx, err)
+		}
+
+		plain, err := gcm.Open(nil, frameNonce(salt, idx), ciphertext, nil)
+		if err != nil {
+			return fmt.Errorf("frame %d failed to decrypt: %s", idx, err)
+		}
+
+		if _, err := w.Write(plain); err != nil {
+			return fmt.Errorf("failed to write frame %d: %s", idx, err)
+		}
+	}
+}
+
+func newGCM(cek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content encryption key: %s", err)
+	}
+
+	return cipher.NewGCM(block)
+}
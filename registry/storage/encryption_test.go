@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func testRSAKeyPair(t *testing.T) (*rsa.PrivateKey, *rsa.PublicKey) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return priv, &priv.PublicKey
+}
+
+func TestEncryptDecryptBlobRoundTrip(t *testing.T) {
+	cek, err := GenerateCEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := bytes.Repeat([]byte("zstack-utility "), 1024)
+
+	var ciphertext bytes.Buffer
+	iv, err := EncryptBlob(&ciphertext, bytes.NewReader(plaintext), cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted bytes.Buffer
+	if err := DecryptBlob(&decrypted, bytes.NewReader(ciphertext.Bytes()), cek, iv); err != nil {
+		t.Fatalf("decrypt failed: %s", err)
+	}
+
+	if !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Fatal("decrypted content does not match original plaintext")
+	}
+}
+
+func TestDecryptBlobWrongKeyFails(t *testing.T) {
+	cek, err := GenerateCEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ciphertext bytes.Buffer
+	iv, err := EncryptBlob(&ciphertext, bytes.NewReader([]byte("secret content")), cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey, err := GenerateCEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted bytes.Buffer
+	if err := DecryptBlob(&decrypted, bytes.NewReader(ciphertext.Bytes()), wrongKey, iv); err == nil {
+		t.Fatal("expected decryption with the wrong key to fail")
+	}
+}
+
+func TestDecryptBlobTamperedFrameFails(t *testing.T) {
+	cek, err := GenerateCEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ciphertext bytes.Buffer
+	iv, err := EncryptBlob(&ciphertext, bytes.NewReader([]byte("secret content")), cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := ciphertext.Bytes()
+	// flip every bit of the last byte of the frame payload (past the
+	// 4-byte length prefix)
+	tampered[len(tampered)-1] ^= 0xff
+
+	var decrypted bytes.Buffer
+	if err := DecryptBlob(&decrypted, bytes.NewReader(tampered), cek, iv); err == nil {
+		t.Fatal("expected GCM tag mismatch on a tampered frame to be detected")
+	}
+}
+
+func TestWrapUnwrapKeyRSAOAEPRoundTrip(t *testing.T) {
+	priv, pub := testRSAKeyPair(t)
+
+	cek, err := GenerateCEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient, err := WrapKeyRSAOAEP("test-key", pub, cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := UnwrapKeyRSAOAEP(priv, recipient)
+	if err != nil {
+		t.Fatalf("unwrap failed: %s", err)
+	}
+
+	if !bytes.Equal(unwrapped, cek) {
+		t.Fatal("unwrapped key does not match original CEK")
+	}
+}
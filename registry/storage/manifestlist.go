@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// Platform identifies the architecture, OS and (for arm) variant an entry
+// in a ManifestList was built for.
+type Platform struct {
+	Arch    string `json:"arch"`
+	OS      string `json:"os"`
+	Variant string `json:"variant,omitempty"`
+}
+
+// ManifestListEntry points at one per-platform ImageManifest making up a
+// ManifestList, analogous to a manifest entry in an OCI image index.
+type ManifestListEntry struct {
+	Digest   string   `json:"digest"`
+	Size     int64    `json:"size"`
+	Platform Platform `json:"platform"`
+}
+
+// ManifestList lets a single name+tag resolve to more than one
+// architecture, each pointing at its own ImageManifest by digest.
+type ManifestList struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	Manifests     []ManifestListEntry `json:"manifests"`
+}
+
+// String encodes the manifest list to JSON.
+func (ml *ManifestList) String() string {
+	buf, _ := json.Marshal(ml)
+	return string(buf)
+}
+
+// defaultPlatform is the platform GetManifest resolves to when the caller
+// does not ask for a specific one.
+func defaultPlatform() Platform {
+	return Platform{Arch: runtime.GOARCH, OS: runtime.GOOS}
+}
+
+type manifestListPathSpec struct {
+	name string
+	tag  string
+}
+
+func (p manifestListPathSpec) pathSpec() string {
+	return fmt.Sprintf("/images/%s/manifestlists/%s.json", p.name, p.tag)
+}
+
+// GetManifestList returns the manifest list stored for name:tag, or nil if
+// the tag does not point at a list.
+func (ims ImageSearcher) GetManifestList(ctx context.Context, name string, tag string) (*ManifestList, error) {
+	ps := manifestListPathSpec{name: strings.ToLower(name), tag: strings.ToLower(tag)}.pathSpec()
+
+	buf, err := ims.driver.GetContent(ctx, ps)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ml ManifestList
+	if err := json.Unmarshal(buf, &ml); err != nil {
+		return nil, fmt.Errorf("invalid manifest list for %s:%s", name, tag)
+	}
+
+	return &ml, nil
+}
+
+// mergeManifestListEntries returns existing with entries appended, each
+// entry replacing any prior entry for the same Platform rather than
+// duplicating it.
+func mergeManifestListEntries(existing []ManifestListEntry, entries ...ManifestListEntry) []ManifestListEntry {
+	for _, e := range entries {
+		kept := existing[:0]
+		for _, prior := range existing {
+			if prior.Platform != e.Platform {
+				kept = append(kept, prior)
+			}
+		}
+		existing = append(kept, e)
+	}
+
+	return existing
+}
+
+// PutManifestList appends entries to the manifest list stored for
+// name:tag, replacing any existing entry for the same platform, rather
+// than overwriting the whole list.
+func (ims ImageSearcher) PutManifestList(ctx context.Context, name string, tag string, entries ...ManifestListEntry) error {
+	name, tag = strings.ToLower(name), strings.ToLower(tag)
+
+	ml, err := ims.GetManifestList(ctx, name, tag)
+	if err != nil {
+		return err
+	}
+
+	if ml == nil {
+		ml = &ManifestList{SchemaVersion: 2}
+	}
+
+	ml.Manifests = mergeManifestListEntries(ml.Manifests, entries...)
+
+	ps := manifestListPathSpec{name: name, tag: tag}.pathSpec()
+	return ims.driver.PutContent(ctx, ps, []byte(ml.String()))
+}
+
+// ResolveManifest is like GetManifest, but when name:ref points at a
+// ManifestList it picks the entry matching platform (the zero Platform
+// means runtime.GOARCH/GOOS) and resolves that entry's digest instead.
+func (ims ImageSearcher) ResolveManifest(ctx context.Context, name string, ref string, platform Platform) (*ImageManifest, error) {
+	if platform == (Platform{}) {
+		platform = defaultPlatform()
+	}
+
+	ml, err := ims.GetManifestList(ctx, name, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if ml == nil {
+		return ims.GetManifest(ctx, name, ref)
+	}
+
+	for _, e := range ml.Manifests {
+		if e.Platform.Arch == platform.Arch && e.Platform.OS == platform.OS {
+			return ims.GetManifest(ctx, name, e.Digest)
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest for %s:%s matches platform %s/%s", name, ref, platform.OS, platform.Arch)
+}
@@ -0,0 +1,37 @@
+package storage
+
+import "testing"
+
+func TestMergeManifestListEntriesAppendsNewPlatform(t *testing.T) {
+	existing := []ManifestListEntry{
+		{Digest: "sha256:amd64", Platform: Platform{Arch: "amd64", OS: "linux"}},
+	}
+
+	merged := mergeManifestListEntries(existing, ManifestListEntry{
+		Digest:   "sha256:arm64",
+		Platform: Platform{Arch: "arm64", OS: "linux"},
+	})
+
+	if len(merged) != 2 {
+		t.Fatalf("got %d entries, want 2", len(merged))
+	}
+}
+
+func TestMergeManifestListEntriesReplacesSamePlatform(t *testing.T) {
+	existing := []ManifestListEntry{
+		{Digest: "sha256:old", Platform: Platform{Arch: "amd64", OS: "linux"}},
+	}
+
+	merged := mergeManifestListEntries(existing, ManifestListEntry{
+		Digest:   "sha256:new",
+		Platform: Platform{Arch: "amd64", OS: "linux"},
+	})
+
+	if len(merged) != 1 {
+		t.Fatalf("got %d entries, want 1 (same platform should replace, not duplicate)", len(merged))
+	}
+
+	if merged[0].Digest != "sha256:new" {
+		t.Fatalf("got digest %q, want the replacement digest", merged[0].Digest)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"image-store/registry/api/errcode"
 	"image-store/utils"
+	"strconv"
 	"strings"
 )
 
@@ -15,15 +16,16 @@ var NotImplemented = errors.New("not implemented")
 
 // The image manifest
 type ImageManifest struct {
-	Id      string   `json:"id"`
-	Parents []string `json:"parents"`
-	Blobsum string   `json:"blobsum"`
-	Created string   `json:"created"`
-	Author  string   `json:"author"`
-	Arch    string   `json:"architecture"`
-	Desc    string   `json:"desc"`
-	Size    int64    `json:"size"`
-	Name    string   `json:"name"`
+	Id         string      `json:"id"`
+	Parents    []string    `json:"parents"`
+	Blobsum    string      `json:"blobsum"`
+	Created    string      `json:"created"`
+	Author     string      `json:"author"`
+	Arch       string      `json:"architecture"`
+	Desc       string      `json:"desc"`
+	Size       int64       `json:"size"`
+	Name       string      `json:"name"`
+	Encryption *Encryption `json:"encryption,omitempty"`
 }
 
 // Encode the image manifest to JSON string
@@ -71,16 +73,44 @@ type Searcher interface {
 
 	// Prepare blob upload
 	PrepareBlobUpload(ctx context.Context, name string, info *UploadInfo) (string, error)
+
+	// Resolve a name+ref to the manifest for platform, following a
+	// ManifestList when name:ref points at one.
+	ResolveManifest(ctx context.Context, name string, ref string, platform Platform) (*ImageManifest, error)
+
+	// Get the manifest list stored for name:tag, nil if tag is not a list.
+	GetManifestList(ctx context.Context, name string, tag string) (*ManifestList, error)
+
+	// Append entries to the manifest list stored for name:tag.
+	PutManifestList(ctx context.Context, name string, tag string, entries ...ManifestListEntry) error
 }
 
 type ImageSearcher struct {
 	driver storagedriver.StorageDriver
+	cache  BlobInfoCache
+	signer Signer
+	policy *Policy
 }
 
 func NewSearcher(d storagedriver.StorageDriver) *ImageSearcher {
 	return &ImageSearcher{driver: d}
 }
 
+// NewSearcherWithCache is like NewSearcher, but records each completed
+// blob upload's location in cache via CompleteBlobUpload.
+func NewSearcherWithCache(d storagedriver.StorageDriver, cache BlobInfoCache) *ImageSearcher {
+	return &ImageSearcher{driver: d, cache: cache}
+}
+
+// WithSigning returns a copy of ims that signs manifests on PutManifest
+// with signer, and enforces policy on GetManifest. Either may be nil to
+// leave signing or verification disabled.
+func (ims ImageSearcher) WithSigning(signer Signer, policy *Policy) *ImageSearcher {
+	ims.signer = signer
+	ims.policy = policy
+	return &ims
+}
+
 func (ims ImageSearcher) FindImages(ctx context.Context, name string) ([]*ImageManifest, error) {
 	return nil, NotImplemented
 }
@@ -104,6 +134,44 @@ func getImageJson(ctx context.Context, d storagedriver.StorageDriver, ps string)
 }
 
 func (ims ImageSearcher) GetManifest(ctx context.Context, name string, ref string) (*ImageManifest, error) {
+	imf, err := ims.getManifestUnverified(ctx, name, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if ims.policy != nil {
+		sig, err := ims.getSignature(ctx, name, imf.Id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature for %s: %s", name, err)
+		}
+
+		if err := ims.policy.Verify(name, []byte(imf.String()), sig); err != nil {
+			return nil, err
+		}
+	}
+
+	return imf, nil
+}
+
+func (ims ImageSearcher) getSignature(ctx context.Context, name, id string) (*Signature, error) {
+	ps := signaturePathSpec{name: strings.ToLower(name), id: id}.pathSpec()
+	buf, err := ims.driver.GetContent(ctx, ps)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sig Signature
+	if err := json.Unmarshal(buf, &sig); err != nil {
+		return nil, err
+	}
+
+	return &sig, nil
+}
+
+func (ims ImageSearcher) getManifestUnverified(ctx context.Context, name string, ref string) (*ImageManifest, error) {
 	// If the reference is a tag -
 	//  1. get the digest via tag
 	//  2. get the manifest via digest
@@ -135,6 +203,17 @@ func (ims ImageSearcher) GetManifest(ctx context.Context, name string, ref strin
 	tps := tagPathSpec{user: mps.user, name: mps.name, tag: refstr}.pathSpec()
 	buf, err := ims.driver.GetContent(ctx, tps)
 	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			// GetManifest does not resolve manifestListPathSpec, so a tag
+			// written only by PutManifestList (e.g. repoadmin's `add
+			// -arch`) looks identical to an unknown tag here. Callers
+			// serving name:ref over HTTP must resolve through
+			// ResolveManifest, not GetManifest, or a list tag is
+			// unreachable; say so instead of returning a plain not-found.
+			if ml, mlErr := ims.GetManifestList(ctx, name, refstr); mlErr == nil && ml != nil {
+				return nil, fmt.Errorf("%s:%s is a manifest list - use ResolveManifest, not GetManifest", name, refstr)
+			}
+		}
 		return nil, err
 	}
 
@@ -166,13 +245,30 @@ func (ims ImageSearcher) PutManifest(ctx context.Context, name string, ref strin
 	}
 
 	// TODO check manifest content and existence
-	mps := manifestsPathSpec{name: idstr}
+	mps := manifestsPathSpec{name: strings.ToLower(name)}
 	ps := imageJsonPathSpec{user: mps.user, name: mps.name, id: idstr}.pathSpec()
 
 	if err := ims.driver.PutContent(ctx, ps, []byte(imf.String())); err != nil {
 		return errors.New("failed to update manifest")
 	}
 
+	if ims.signer != nil {
+		sig, err := ims.signer.Sign(imf)
+		if err != nil {
+			return fmt.Errorf("failed to sign manifest: %s", err)
+		}
+
+		buf, err := json.Marshal(sig)
+		if err != nil {
+			return fmt.Errorf("failed to encode signature: %s", err)
+		}
+
+		sps := signaturePathSpec{name: mps.name, id: idstr}.pathSpec()
+		if err := ims.driver.PutContent(ctx, sps, buf); err != nil {
+			return fmt.Errorf("failed to store signature: %s", err)
+		}
+	}
+
 	if !isdigest {
 		tps := tagPathSpec{user: mps.user, name: mps.name, tag: refstr}.pathSpec()
 		if err := ims.driver.PutContent(ctx, tps, []byte(idstr)); err != nil {
@@ -218,10 +314,21 @@ func (ims ImageSearcher) PrepareBlobUpload(ctx context.Context, name string, inf
 	digest := strings.TrimSpace(info.Digest)
 	bps := blobDigestPathSpec{digest: digest}.pathSpec()
 	if _, err := ims.driver.Stat(ctx, bps); err == nil {
+		// blobDigestPathSpec is keyed on digest alone, so this Stat is
+		// already the dedup check: any blob previously completed under
+		// this digest, by any name, lives at exactly this path. There is
+		// no separate "mount from elsewhere" case to short-circuit -
+		// ims.cache's role is limited to CompleteBlobUpload bookkeeping
+		// until blob storage is name-scoped.
 		return "", errcode.ConflictError{Resource: digest}
 	}
 
-	uu := utils.NewUUID()
+	// The upload id is derived from the digest, not a fresh random UUID,
+	// so that re-running `add` against the same content after an
+	// interrupted upload lands on the same id - and therefore the same
+	// RecordChunkCommitted/CommittedChunkOffset trail - instead of
+	// starting a brand new session that always resumes from chunk 0.
+	uu := uploadIDForDigest(digest)
 	ucps := uploadCheckSumPathSpec{name: name, id: uu}.pathSpec()
 	if err := ims.driver.PutContent(ctx, ucps, []byte(digest)); err != nil {
 		return "", err
@@ -230,3 +337,55 @@ func (ims ImageSearcher) PrepareBlobUpload(ctx context.Context, name string, inf
 	urlps := uploadUuidPathSpec{name: name, id: uu}.urlSpec()
 	return urlps, nil
 }
+
+// uploadIDForDigest turns a "sha256:..." digest into a value safe to use
+// as a path component for the upload id.
+func uploadIDForDigest(digest string) string {
+	return strings.NewReplacer(":", "-").Replace(digest)
+}
+
+// CompleteBlobUpload records digest as having just been committed to
+// storage at its usual blobDigestPathSpec location. PrepareBlobUpload no
+// longer reads this back - within a single, digest-keyed blob store that
+// lookup could never help, since the path it would resolve to is already
+// the one the preceding Stat checked - but it keeps ims.cache's location
+// index accurate for a future name-scoped store or external tooling.
+// Callers must invoke it once a blob upload they drove has really
+// finished, not merely been prepared.
+func (ims ImageSearcher) CompleteBlobUpload(digest string, size int64) {
+	if ims.cache == nil {
+		return
+	}
+
+	bps := blobDigestPathSpec{digest: digest}.pathSpec()
+	ims.cache.RecordKnownLocation(digest, BlobLocation{Path: bps, CompressedSize: size})
+}
+
+// RecordChunkCommitted advances the resume counter for upload id to
+// index+1, so CommittedChunkOffset for the same id picks up after the
+// chunk that was just committed instead of restarting from chunk 0.
+func (ims ImageSearcher) RecordChunkCommitted(ctx context.Context, name string, id string, index int) error {
+	uops := uploadOffsetPathSpec{name: name, id: id}.pathSpec()
+	return ims.driver.PutContent(ctx, uops, []byte(strconv.Itoa(index+1)))
+}
+
+// CommittedChunkOffset returns the chunk index to resume upload id from,
+// as last recorded by RecordChunkCommitted, or 0 if no chunk of this
+// upload has been committed yet.
+func (ims ImageSearcher) CommittedChunkOffset(ctx context.Context, name string, id string) (int, error) {
+	uops := uploadOffsetPathSpec{name: name, id: id}.pathSpec()
+	buf, err := ims.driver.GetContent(ctx, uops)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid upload offset for %s: %s", id, err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func signManifest(t *testing.T, priv ed25519.PrivateKey, keyID, signer string, content []byte) *Signature {
+	t.Helper()
+	return &Signature{
+		KeyID:     keyID,
+		Signer:    signer,
+		Algorithm: "ed25519",
+		Sig:       ed25519.Sign(priv, content),
+	}
+}
+
+func TestPolicyVerifyRejectsUnsignedByDefault(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{Default: []PolicyRequirement{{Type: "signedBy", KeyData: pub}}}
+
+	if err := p.Verify("myimage", []byte("content"), nil); err == nil {
+		t.Fatal("expected unsigned image to be rejected")
+	}
+}
+
+func TestPolicyVerifyAcceptsValidSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte(`{"id":"sha256:abc"}`)
+	p := &Policy{Default: []PolicyRequirement{{Type: "signedBy", KeyData: pub}}}
+	sig := signManifest(t, priv, "key1", "alice", content)
+
+	if err := p.Verify("myimage", content, sig); err != nil {
+		t.Fatalf("expected valid signature to be accepted, got: %s", err)
+	}
+}
+
+func TestPolicyVerifyRejectsWrongSigner(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte(`{"id":"sha256:abc"}`)
+	p := &Policy{Default: []PolicyRequirement{{Type: "signedBy", KeyData: pub, SignedIdentity: "bob"}}}
+	sig := signManifest(t, priv, "key1", "alice", content)
+
+	if err := p.Verify("myimage", content, sig); err == nil {
+		t.Fatal("expected signature from unexpected signer to be rejected")
+	}
+}
+
+func TestPolicyVerifyGlobMatchesTransportRule(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{
+		Default: []PolicyRequirement{{Type: "insecureAcceptAnything"}},
+		Transports: map[string][]PolicyRequirement{
+			"internal/*": {{Type: "signedBy", KeyData: pub}},
+		},
+	}
+
+	// "internal/base" matches the "internal/*" glob, so it must fall
+	// through to the stricter signedBy rule rather than the permissive
+	// default - an unsigned pull of it must be rejected.
+	if err := p.Verify("internal/base", []byte("content"), nil); err == nil {
+		t.Fatal("expected glob-matched transport rule to reject an unsigned image")
+	}
+
+	// A name that does not match the glob still falls back to Default.
+	if err := p.Verify("public/base", []byte("content"), nil); err != nil {
+		t.Fatalf("expected non-matching name to fall back to insecureAcceptAnything, got: %s", err)
+	}
+}
+
+func TestPolicyVerifyReject(t *testing.T) {
+	p := &Policy{Default: []PolicyRequirement{{Type: "reject"}}}
+
+	if err := p.Verify("banned", []byte("content"), nil); err == nil {
+		t.Fatal("expected reject rule to fail closed")
+	}
+}
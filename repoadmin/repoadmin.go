@@ -3,19 +3,40 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"image-store/config"
 	"image-store/registry/api/v1"
 	"image-store/registry/storage"
 	"image-store/registry/storage/driver/factory"
 	"image-store/utils"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"time"
 )
 
+// archFlags collects repeated -arch flags into a slice, so `add` can
+// register the same blob under several platforms in one invocation.
+type archFlags []string
+
+func (a *archFlags) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *archFlags) Set(v string) error {
+	*a = append(*a, v)
+	return nil
+}
+
 var (
 	// global command line options
 	fconf = flag.String("conf", "zstore.yaml", "zstore configure file")
@@ -26,19 +47,33 @@ var (
 )
 
 func createStorageFrontend(config *config.Configuration) (storage.IStorageFE, error) {
-	// Get storage parameters.
-	storageParams, err := config.Storage.Parameters()
+	driver, err := createStorageDriver(config)
 	if err != nil {
 		return nil, err
 	}
 
-	typ, _ := config.Storage.Type()
-	driver, err := factory.Create(typ, storageParams)
+	return storage.NewStorageFrontend(driver), nil
+}
+
+func createSearcher(config *config.Configuration) (*storage.ImageSearcher, error) {
+	driver, err := createStorageDriver(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return storage.NewStorageFrontend(driver), nil
+	cache := storage.NewJSONBlobInfoCache(bgctx, driver)
+	return storage.NewSearcherWithCache(driver, cache), nil
+}
+
+func createStorageDriver(config *config.Configuration) (storagedriver.StorageDriver, error) {
+	// Get storage parameters.
+	storageParams, err := config.Storage.Parameters()
+	if err != nil {
+		return nil, err
+	}
+
+	typ, _ := config.Storage.Type()
+	return factory.Create(typ, storageParams)
 }
 
 func newFlagSet(id string) *flag.FlagSet {
@@ -52,11 +87,23 @@ func newFlagSet(id string) *flag.FlagSet {
 	return fs
 }
 
-func uploadFile(sfe storage.IStorageFE, fh *os.File, size int64, name string, id string) error {
+// uploadFile uploads fh in BlobChunkSize chunks, one GetChunkWriter call
+// per chunk. It is safe to call again for the same upload id: chunks
+// already committed by a previous, interrupted run - as recorded by
+// searcher.RecordChunkCommitted - are skipped so the upload resumes
+// instead of restarting from chunk 0.
+func uploadFile(sfe storage.IStorageFE, searcher *storage.ImageSearcher, fh *os.File, size int64, name string, id string) error {
 	var buffer []byte
-	offset, cache := int64(0), make([]byte, v1.BlobChunkSize)
+	cache := make([]byte, v1.BlobChunkSize)
 
-	for index := 0; offset < size; index++ {
+	startIndex, err := searcher.CommittedChunkOffset(bgctx, name, id)
+	if err != nil {
+		return fmt.Errorf("failed to resume upload %s: %s", id, err)
+	}
+
+	offset := int64(startIndex) * v1.BlobChunkSize
+
+	for index := startIndex; offset < size; index++ {
 		if offset+v1.BlobChunkSize <= size {
 			buffer = cache
 		} else {
@@ -89,6 +136,10 @@ func uploadFile(sfe storage.IStorageFE, fh *os.File, size int64, name string, id
 			return fmt.Errorf("failed to commit chunk #%d:%s", index, err)
 		}
 
+		if err := searcher.RecordChunkCommitted(bgctx, name, id, index); err != nil {
+			return fmt.Errorf("failed to record progress for chunk #%d:%s", index, err)
+		}
+
 		offset += v1.BlobChunkSize
 	}
 
@@ -99,21 +150,25 @@ func uploadFile(sfe storage.IStorageFE, fh *os.File, size int64, name string, id
 	return nil
 }
 
-func doAdd(sfe storage.IStorageFE, args []string) error {
+func doAdd(cfg *config.Configuration, sfe storage.IStorageFE, args []string) error {
 	addcmd := newFlagSet("add")
 
 	ffile := addcmd.String("file", "", "the path to image file")
 	fname := addcmd.String("name", "", "the image name ('ubuntu' etc.)")
 	fauth := addcmd.String("author", "", "the author of the image")
-	farch := addcmd.String("arch", "", "the CPU arch of the image")
 	fdesc := addcmd.String("desc", "", "description of the image")
+	ftag := addcmd.String("tag", "latest", "the tag to append this arch's manifest to")
+	fos := addcmd.String("os", "linux", "the OS of the image (applies to every -arch entry)")
+	fencrypt := addcmd.String("encrypt-to", "", "path to a recipient RSA public key (PEM) to encrypt the blob for")
+
+	var farchs archFlags
+	addcmd.Var(&farchs, "arch", "the CPU arch of the image (repeatable to add several)")
 
 	addcmd.Parse(args)
 
 	mustHaveArgs := map[string]string{
 		"name": *fname,
 		"file": *ffile,
-		"arch": *farch,
 	}
 
 	for key, value := range mustHaveArgs {
@@ -122,6 +177,10 @@ func doAdd(sfe storage.IStorageFE, args []string) error {
 		}
 	}
 
+	if len(farchs) == 0 {
+		return fmt.Errorf("missing args for -arch")
+	}
+
 	fh, err := os.Open(*ffile)
 	if err != nil {
 		return fmt.Errorf("failed to open %s:%s", *ffile, err)
@@ -134,27 +193,239 @@ func doAdd(sfe storage.IStorageFE, args []string) error {
 		return fmt.Errorf("failed to stat %s:%s", *ffile, err)
 	}
 
-	uploadinfo := v1.UploadInfo{Size: info.Size()}
+	// srcfh/uploadsize are swapped out for an encrypted temp file below when
+	// -encrypt-to is given, so that the digest computed during upload is
+	// always the digest of what ends up on disk server-side.
+	srcfh, uploadsize := fh, info.Size()
+	var encryption *storage.Encryption
+
+	if *fencrypt != "" {
+		pub, err := loadRSAPublicKey(*fencrypt)
+		if err != nil {
+			return err
+		}
+
+		cek, err := storage.GenerateCEK()
+		if err != nil {
+			return err
+		}
+
+		tmp, err := ioutil.TempFile("", "zstore-encrypt-")
+		if err != nil {
+			return fmt.Errorf("failed to create temp file for encryption: %s", err)
+		}
+
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		iv, err := storage.EncryptBlob(tmp, fh, cek)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %s", *ffile, err)
+		}
+
+		tinfo, err := tmp.Stat()
+		if err != nil {
+			return err
+		}
+
+		recipient, err := storage.WrapKeyRSAOAEP(*fencrypt, pub, cek)
+		if err != nil {
+			return err
+		}
+
+		srcfh, uploadsize = tmp, tinfo.Size()
+		encryption = &storage.Encryption{
+			Scheme:     "aes-256-gcm",
+			Recipients: []storage.Recipient{recipient},
+			IV:         iv,
+		}
+	}
+
+	searcher, err := createSearcher(cfg)
+	if err != nil {
+		return err
+	}
+
+	uploadinfo := v1.UploadInfo{Size: uploadsize}
 	uups, err := sfe.PrepareBlobUpload(bgctx, *fname, &uploadinfo)
 	if err != nil {
 		return fmt.Errorf("prepare upload failed:%s", err)
 	}
 
-	err = uploadFile(sfe, fh, info.Size(), *fname, path.Base(uups))
-	if err != nil {
+	uploadID := path.Base(uups)
+	if err := uploadFile(sfe, searcher, srcfh, uploadsize, *fname, uploadID); err != nil {
 		return err
 	}
 
+	// srcfh was only ever read chunk-by-chunk via ReadAt above, so its own
+	// content digest - what CompleteBlobUpload records in the BlobInfoCache -
+	// still needs computing now that every chunk has landed.
+	if _, err := srcfh.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to compute blob digest: %s", err)
+	}
+
+	digest, err := utils.Sha256Sum(srcfh)
+	if err != nil {
+		return fmt.Errorf("failed to compute blob digest: %s", err)
+	}
+
+	searcher.CompleteBlobUpload(digest, uploadsize)
+
+	if encryption != nil {
+		fmt.Println("encryption:", encryption.Scheme, "recipients:", len(encryption.Recipients))
+	}
+
+	// Entry.Digest is resolved server- and client-side as an ImageManifest
+	// id (GetManifest/getImageManifest), not the blob content digest, so
+	// each -arch needs its own per-platform ImageManifest put under its
+	// own id before it can be referenced from the list.
+	entries := make([]storage.ManifestListEntry, len(farchs))
+	for i, arch := range farchs {
+		idbuf := bytes.NewReader([]byte(fmt.Sprintf("%s:%s:%s", digest, *fname, arch)))
+		imfID, err := utils.Sha256Sum(idbuf)
+		if err != nil {
+			return fmt.Errorf("failed to compute manifest id for arch %s: %s", arch, err)
+		}
+
+		imf := &storage.ImageManifest{
+			Id:         imfID,
+			Blobsum:    digest,
+			Created:    time.Now().UTC().Format(time.RFC3339),
+			Author:     *fauth,
+			Arch:       arch,
+			Desc:       *fdesc,
+			Size:       uploadsize,
+			Name:       *fname,
+			Encryption: encryption,
+		}
+
+		if err := searcher.PutManifest(bgctx, *fname, imf.Id, imf); err != nil {
+			return fmt.Errorf("failed to put manifest for arch %s: %s", arch, err)
+		}
+
+		entries[i] = storage.ManifestListEntry{
+			Digest:   imf.Id,
+			Size:     uploadsize,
+			Platform: storage.Platform{Arch: arch, OS: *fos},
+		}
+	}
+
+	if err := searcher.PutManifestList(bgctx, *fname, *ftag, entries...); err != nil {
+		return fmt.Errorf("failed to update manifest list: %s", err)
+	}
+
 	fmt.Println("adding image:", *fauth, *fdesc, uups)
 	return nil
 }
 
-func withStorageFrontend(sfe storage.IStorageFE, cmd string, args []string) error {
+func loadRSAPublicKey(keypath string) (*rsa.PublicKey, error) {
+	buf, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %s", keypath, err)
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM-encoded key", keypath)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %s", keypath, err)
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", keypath)
+	}
+
+	return rsaPub, nil
+}
+
+// doSign signs an already-pushed manifest offline, writing the detached
+// signature alongside it so that a policy-enforcing GetManifest will
+// accept subsequent pulls.
+func doSign(searcher *storage.ImageSearcher, args []string) error {
+	signcmd := newFlagSet("sign")
+
+	fname := signcmd.String("name", "", "the image name")
+	fref := signcmd.String("ref", "", "the image tag or digest to sign")
+	fkey := signcmd.String("key", "", "path to an ed25519 private key")
+	fsigner := signcmd.String("signer", "", "the signer identity to record")
+	fkeyid := signcmd.String("keyid", "", "the key id to record")
+
+	signcmd.Parse(args)
+
+	for key, value := range map[string]string{"name": *fname, "ref": *fref, "key": *fkey} {
+		if value == "" {
+			return fmt.Errorf("missing args for -%s", key)
+		}
+	}
+
+	keybuf, err := ioutil.ReadFile(*fkey)
+	if err != nil {
+		return fmt.Errorf("failed to read key %s: %s", *fkey, err)
+	}
+
+	if len(keybuf) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s is not a raw ed25519 private key", *fkey)
+	}
+
+	imf, err := searcher.GetManifest(bgctx, *fname, *fref)
+	if err != nil {
+		return fmt.Errorf("failed to look up manifest: %s", err)
+	}
+
+	signed := searcher.WithSigning(storage.NewEd25519Signer(*fkeyid, *fsigner, ed25519.PrivateKey(keybuf)), nil)
+	if err := signed.PutManifest(bgctx, *fname, imf.Id, imf); err != nil {
+		return fmt.Errorf("failed to sign manifest: %s", err)
+	}
+
+	fmt.Println("signed:", *fname, imf.Id)
+	return nil
+}
+
+// doVerify checks a pushed manifest against a policy.json-style file
+// without downloading its blob.
+func doVerify(searcher *storage.ImageSearcher, args []string) error {
+	verifycmd := newFlagSet("verify")
+
+	fname := verifycmd.String("name", "", "the image name")
+	fref := verifycmd.String("ref", "", "the image tag or digest to verify")
+	fpolicy := verifycmd.String("policy", "policy.json", "path to a policy.json file")
+
+	verifycmd.Parse(args)
+
+	for key, value := range map[string]string{"name": *fname, "ref": *fref} {
+		if value == "" {
+			return fmt.Errorf("missing args for -%s", key)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(*fpolicy)
+	if err != nil {
+		return fmt.Errorf("failed to read policy %s: %s", *fpolicy, err)
+	}
+
+	policy, err := storage.ParsePolicy(buf)
+	if err != nil {
+		return err
+	}
+
+	if _, err := searcher.WithSigning(nil, policy).GetManifest(bgctx, *fname, *fref); err != nil {
+		return fmt.Errorf("verification failed: %s", err)
+	}
+
+	fmt.Println("verified:", *fname, *fref)
+	return nil
+}
+
+func withStorageFrontend(cfg *config.Configuration, sfe storage.IStorageFE, cmd string, args []string) error {
 	switch cmd {
 	default:
 		return fmt.Errorf("unexpected command: '%s'", cmd)
 	case "add":
-		return doAdd(sfe, args)
+		return doAdd(cfg, sfe, args)
 	}
 }
 
@@ -185,13 +456,35 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch args[0] {
+	case "sign", "verify":
+		searcher, err := createSearcher(cfg)
+		if err != nil {
+			fmt.Println("failed to create searcher:", err)
+			os.Exit(1)
+		}
+
+		if args[0] == "sign" {
+			err = doSign(searcher, args[1:])
+		} else {
+			err = doVerify(searcher, args[1:])
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	sfe, err := createStorageFrontend(cfg)
 	if err != nil {
 		fmt.Println("failed to create storage frontend:", err)
 		os.Exit(1)
 	}
 
-	if err = withStorageFrontend(sfe, args[0], args[1:]); err != nil {
+	if err = withStorageFrontend(cfg, sfe, args[0], args[1:]); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}